@@ -1,27 +1,56 @@
 package goping
 
 import (
+	"context"
 	"errors"
+	"fmt"
 	"math"
 	"net"
 	"sync"
 	"sync/atomic"
 	"time"
 
+	"go.uber.org/multierr"
 	"golang.org/x/net/icmp"
 	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
 )
 
+//icmpv4FragNeededCode is the IPv4 Destination Unreachable code meaning
+//"fragmentation needed and DF was set" (RFC 1191).
+const icmpv4FragNeededCode = 4
+
 /*** Structures ***/
 
 //Config is the configures a GoPing object
 type Config struct {
-	Count      int
-	Interval   time.Duration
-	Timeout    time.Duration
-	TOS        int
-	TTL        int
-	PacketSize int
+	Count        int
+	Interval     time.Duration
+	Timeout      time.Duration
+	TOS          int
+	TTL          int
+	PacketSize   int
+	Unprivileged bool //use a SOCK_DGRAM ICMP socket instead of a raw socket, avoiding the need for CAP_NET_RAW
+	KeepRtts     bool //keep the raw per-iteration RTT slice in Statistics.Rtts; Min/Max/Avg/StdDevRtt are always computed
+
+	//DontFragment sets the IPv4 header's Don't Fragment flag on outbound
+	//packets. Combined with a large PacketSize, it turns a ping into a Path
+	//MTU probe: a hop that can't forward the packet without fragmenting it
+	//returns an ErrFragmentationNeeded instead of relaying it onward.
+	DontFragment bool
+
+	//Traceroute turns each Request iteration into a probe with an
+	//increasing TTL (1, 2, 3, ...) instead of a fixed-TTL echo, so the
+	//Responses trace the path to Host one hop at a time. MaxHops bounds how
+	//high the TTL climbs; Probes is how many probes are sent per hop. The
+	//Request stops itself (Response.Final, regardless of Config.Count) once
+	//an EchoReply shows the destination answered, or once every probe for
+	//hop MaxHops has gone unanswered. Traceroute cannot be combined with
+	//Unprivileged: a per-probe TTL requires a raw socket, so a Pinger
+	//should report an error rather than silently ignoring the TTL.
+	Traceroute bool
+	MaxHops    int
+	Probes     int
 }
 
 //Request represents a Ping Job. A request can generate 1 to Count responses
@@ -41,13 +70,108 @@ type Response struct {
 	Seq     int
 	Err     error
 	RawResponse
+
+	Final      bool //true on the last Response of a Request; Statistics is populated
+	Statistics Statistics
 }
 
 //RawResponse: Responses generated by the pinger implementation
 type RawResponse struct {
 	RTT         float64
 	From        net.IP
+	TTL         int //the probe TTL this RawResponse answers; only meaningful when Config.Traceroute is set
+	NextHopMTU  int //the MTU reported by an ErrFragmentationNeeded reply; 0 otherwise
 	ICMPMessage icmp.Message
+
+	//Err is set by the Pinger when the probe never got far enough to
+	//produce an ICMPMessage to classify (e.g. the host didn't resolve, or
+	//the underlying send failed). When set, Start() reports it directly
+	//instead of switching on ICMPMessage.Type.
+	Err error
+}
+
+//Statistics summarizes every iteration sent so far for a Request. It is
+//attached to the last Response of a Request (Response.Final == true) and/or
+//delivered through the Gopinger's OnFinish callback.
+type Statistics struct {
+	PacketsSent int
+	PacketsRecv int
+	PacketLoss  float64 //percentage of PacketsSent that got no reply
+	MinRtt      float64
+	MaxRtt      float64
+	AvgRtt      float64
+	StdDevRtt   float64
+	Rtts        []float64 //raw per-iteration RTTs, nil unless Config.KeepRtts is set
+}
+
+//statAccumulator incrementally builds a Statistics for one Request, using
+//Welford's algorithm so the running mean/stddev don't require keeping every
+//sample when the caller opts out of Config.KeepRtts.
+type statAccumulator struct {
+	sent, recv int
+	mean, m2   float64 //Welford's running mean and sum of squares of differences from the mean
+	min, max   float64
+	rtts       []float64
+}
+
+func newStatAccumulator() *statAccumulator {
+	return &statAccumulator{min: math.Inf(1), max: math.Inf(-1)}
+}
+
+func (a *statAccumulator) addSent() {
+	a.sent++
+}
+
+func (a *statAccumulator) addRtt(rtt float64, keepRtts bool) {
+	a.recv++
+	a.mean, a.m2 = welfordUpdate(a.recv, a.mean, a.m2, rtt)
+	if rtt < a.min {
+		a.min = rtt
+	}
+	if rtt > a.max {
+		a.max = rtt
+	}
+	if keepRtts {
+		a.rtts = append(a.rtts, rtt)
+	}
+}
+
+//welfordUpdate folds one more sample into a running mean/M2 pair using
+//Welford's online algorithm.
+func welfordUpdate(n int, mean, m2, x float64) (newMean, newM2 float64) {
+	delta := x - mean
+	newMean = mean + delta/float64(n)
+	newM2 = m2 + delta*(x-newMean)
+	return newMean, newM2
+}
+
+func (a *statAccumulator) snapshot() Statistics {
+	s := Statistics{
+		PacketsSent: a.sent,
+		PacketsRecv: a.recv,
+		Rtts:        a.rtts,
+	}
+	if a.sent > 0 {
+		s.PacketLoss = 100 * float64(a.sent-a.recv) / float64(a.sent)
+	}
+	if a.recv > 0 {
+		s.MinRtt, s.MaxRtt, s.AvgRtt = a.min, a.max, a.mean
+		s.StdDevRtt = math.Sqrt(a.m2 / float64(a.recv))
+	}
+	return s
+}
+
+//ErrFragmentationNeeded is the Response.Err for a probe sent with
+//Config.DontFragment that came back as an IPv4 Destination Unreachable,
+//code 4: some hop's link couldn't carry the packet without fragmenting it.
+//NextHopMTU is that hop's MTU, also available on the Response's
+//RawResponse.NextHopMTU.
+type ErrFragmentationNeeded struct {
+	NextHopMTU int
+}
+
+func (e *ErrFragmentationNeeded) Error() string {
+	return fmt.Sprintf("fragmentation needed, next-hop mtu %d", e.NextHopMTU)
 }
 
 /*** Interfaces ***/
@@ -63,21 +187,70 @@ type Logger interface {
 
 //Pinger is responsible for send and receive pings over the network
 type Pinger interface {
-	Ping(r Request) (future <-chan RawResponse, seq int, err error)
+	Ping(ctx context.Context, r Request) (future <-chan RawResponse, seq int, err error)
+	Close() error //releases the underlying PacketConn(s), unblocking any in-flight reads
 }
 
 //GoPing Coordinates ping requests and responses
 type Gopinger interface {
 	NewRequest(hostname string, userData map[string]string) Request
-	Start() (chan<- Request, <-chan Response)
+	Start(ctx context.Context) (chan<- Request, <-chan Response)
+	OnFinish(f func(*Statistics)) //f is called once a Request sends its last iteration. Set before Start.
+	Close() error                 //cancels ctx, closes the Pinger and waits for outstanding requests to drain
 }
 
 /*** Interface Implementation ***/
 type goping struct {
-	idGen  uint64
-	cfg    Config
-	log    Logger
-	pinger Pinger
+	idGen    uint64
+	cfg      Config
+	log      Logger
+	pinger   Pinger
+	onFinish func(*Statistics)
+
+	statsMu sync.Mutex
+	stats   map[uint64]*statAccumulator
+
+	wg     sync.WaitGroup
+	cancel context.CancelFunc
+}
+
+func (g *goping) OnFinish(f func(*Statistics)) {
+	g.onFinish = f
+}
+
+//statAccumulatorFor returns the statAccumulator tracking recv.Id, creating it
+//on the first call.
+func (g *goping) statAccumulatorFor(id uint64) *statAccumulator {
+	g.statsMu.Lock()
+	defer g.statsMu.Unlock()
+	a, ok := g.stats[id]
+	if !ok {
+		a = newStatAccumulator()
+		g.stats[id] = a
+	}
+	return a
+}
+
+//tracerouteFinished reports whether a traceroute Request should stop
+//iterating early, overriding Config.Count: once an EchoReply shows the
+//destination itself answered, or once every probe for the last hop
+//(Config.MaxHops) has been sent without one. It is a no-op for a plain,
+//non-traceroute Request.
+func tracerouteFinished(recv Request, reachedDestination bool) bool {
+	if !recv.Config.Traceroute {
+		return false
+	}
+	if reachedDestination {
+		return true
+	}
+	if recv.Config.MaxHops <= 0 {
+		return false
+	}
+	probes := recv.Config.Probes
+	if probes < 1 {
+		probes = 1
+	}
+	return int(recv.Sent) >= recv.Config.MaxHops*probes
 }
 
 func (g *goping) NewRequest(hostname string, userData map[string]string) Request {
@@ -90,17 +263,27 @@ func (g *goping) NewRequest(hostname string, userData map[string]string) Request
 	}
 }
 
-func (g *goping) Start() (chan<- Request, <-chan Response) {
+func (g *goping) Start(ctx context.Context) (chan<- Request, <-chan Response) {
+	ctx, cancel := context.WithCancel(ctx)
+	g.cancel = cancel
+
 	in := make(chan Request)
 	pin := make(chan Request)
 	out := make(chan Response)
 	doneIn := make(chan struct{})
 	done := make(chan struct{})
-	var wg sync.WaitGroup
+	var closeOut sync.Once
 
 	go func(in chan Request, out chan Response) {
 		for {
 			select {
+			case <-ctx.Done():
+				go func() {
+					g.wg.Wait()
+					closeOut.Do(func() { close(out) })
+				}()
+				return
+
 			case recv, open := <-in:
 				if !open {
 					//Stop reading from channel
@@ -110,15 +293,19 @@ func (g *goping) Start() (chan<- Request, <-chan Response) {
 						doneIn <- struct{}{}
 					}()
 				} else {
-					wg.Add(1)
+					g.wg.Add(1)
 					if recv.Config.Count == 0 {
 						//Request  Count is 0. Job is done without sending any requests
-						wg.Done()
+						g.wg.Done()
 					} else {
 						//Send request to be processed
-						go func() {
-							pin <- recv
-						}()
+						go func(recv Request) {
+							select {
+							case pin <- recv:
+							case <-ctx.Done():
+								g.wg.Done()
+							}
+						}(recv)
 					}
 				}
 
@@ -126,11 +313,15 @@ func (g *goping) Start() (chan<- Request, <-chan Response) {
 				//Incrementing Request Sent Counter
 				recv.Sent++
 
+				//Tracks this iteration against the Request's running Statistics
+				stats := g.statAccumulatorFor(recv.Id)
+				stats.addSent()
+
 				//Calling Ping method of the pinger interface
-				future, seq, err := g.pinger.Ping(recv)
+				future, seq, err := g.pinger.Ping(ctx, recv)
 
 				//waiting for a response in a goroutine
-				go func(recv Request, future <-chan RawResponse, seq int, err error) {
+				go func(recv Request, future <-chan RawResponse, seq int, err error, stats *statAccumulator) {
 
 					//Builds the response object
 					resp := Response{
@@ -143,23 +334,46 @@ func (g *goping) Start() (chan<- Request, <-chan Response) {
 					//Start a timer to the request interval
 					waitInterval := time.After(recv.Config.Interval)
 
+					//Set when the ICMP reply is an EchoReply: the destination
+					//itself answered, which is what stops a traceroute early
+					//(see tracerouteFinished below), regardless of how many hops
+					//or probes are left.
+					reachedDestination := false
+
 					if resp.Err == nil {
 						timeout := time.After(recv.Config.Timeout)
 						select {
+						case <-ctx.Done():
+							resp.Err = ctx.Err()
 						case <-timeout:
 							resp.Err = errors.New("Timeout")
 						case r := <-future:
 							resp.RawResponse = r
+							if r.Err != nil {
+								//The probe never produced an ICMP reply to classify (e.g.
+								//the host didn't resolve, or the send itself failed).
+								resp.Err = r.Err
+								break
+							}
 							switch r.ICMPMessage.Type {
-							case ipv4.ICMPTypeEcho:
-							case ipv4.ICMPTypeEchoReply:
-							case ipv4.ICMPTypeDestinationUnreachable:
-								resp.Err = errors.New("Destination Unreachable")
-							case ipv4.ICMPTypeTimeExceeded:
-								resp.Err = errors.New("Time Exceeded")
-							case ipv4.ICMPTypeParameterProblem:
+							case ipv4.ICMPTypeEcho, ipv6.ICMPTypeEchoRequest:
+							case ipv4.ICMPTypeEchoReply, ipv6.ICMPTypeEchoReply:
+								reachedDestination = true
+							case ipv4.ICMPTypeDestinationUnreachable, ipv6.ICMPTypeDestinationUnreachable:
+								if r.ICMPMessage.Type == ipv4.ICMPTypeDestinationUnreachable && r.ICMPMessage.Code == icmpv4FragNeededCode {
+									resp.Err = &ErrFragmentationNeeded{NextHopMTU: r.NextHopMTU}
+								} else {
+									resp.Err = errors.New("Destination Unreachable")
+								}
+							case ipv4.ICMPTypeTimeExceeded, ipv6.ICMPTypeTimeExceeded:
+								//A hop along the path, not the final destination. Expected
+								//while tracerouting; an error for a plain ping.
+								if !recv.Config.Traceroute {
+									resp.Err = errors.New("Time Exceeded")
+								}
+							case ipv4.ICMPTypeParameterProblem, ipv6.ICMPTypeParameterProblem:
 								resp.Err = errors.New("Parameter Problem")
-							case ipv4.ICMPTypeRedirect:
+							case ipv4.ICMPTypeRedirect, ipv6.ICMPTypeRedirect:
 								resp.Err = errors.New("Redirect")
 							default:
 								//TODO: Recognize all possible ICMP TYpes
@@ -168,25 +382,58 @@ func (g *goping) Start() (chan<- Request, <-chan Response) {
 						}
 					}
 
-					//Send response to out channel. Blocks until user consumes it
-					out <- resp
+					if resp.Err == nil {
+						stats.addRtt(resp.RTT, recv.Config.KeepRtts)
+					}
+
+					finished := ctx.Err() != nil ||
+						(recv.Config.Count >= 0 && int(recv.Sent) >= recv.Config.Count) ||
+						tracerouteFinished(recv, reachedDestination)
+					if finished {
+						//This was the last iteration, naturally or because ctx was canceled. Attach the final Statistics to the Response
+						resp.Final = true
+						resp.Statistics = stats.snapshot()
+						g.statsMu.Lock()
+						delete(g.stats, recv.Id)
+						g.statsMu.Unlock()
+						if g.onFinish != nil {
+							g.onFinish(&resp.Statistics)
+						}
+					}
+
+					//Send response to out channel. Blocks until user consumes it, unless ctx is canceled first
+					select {
+					case out <- resp:
+					case <-ctx.Done():
+						g.wg.Done()
+						return
+					}
 
-					if recv.Config.Count >= 0 && int(recv.Sent) >= recv.Config.Count {
-						//This was the last request. Job Done
-						wg.Done()
+					if finished {
+						//Job Done
+						g.wg.Done()
 					} else {
 						//We still have more requests to do. Waits for the request interval and send request to pin channel again
-						<-waitInterval
-						pin <- recv
+						select {
+						case <-waitInterval:
+						case <-ctx.Done():
+							g.wg.Done()
+							return
+						}
+						select {
+						case pin <- recv:
+						case <-ctx.Done():
+							g.wg.Done()
+						}
 					}
-				}(recv, future, seq, err)
+				}(recv, future, seq, err, stats)
 
 			case <-doneIn:
-				go func(wg *sync.WaitGroup, out chan Response, done chan struct{}) {
-					wg.Wait()
-					close(out)
+				go func() {
+					g.wg.Wait()
+					closeOut.Do(func() { close(out) })
 					done <- struct{}{}
-				}(&wg, out, done)
+				}()
 
 			case <-done:
 				return
@@ -198,11 +445,28 @@ func (g *goping) Start() (chan<- Request, <-chan Response) {
 	return in, out
 }
 
+//Close cancels the context passed to Start (unblocking any goroutine
+//waiting on a channel send or timer), closes the underlying Pinger so its
+//blocking reads return, and waits for every in-flight request goroutine to
+//observe the cancellation and call g.wg.Done before returning.
+func (g *goping) Close() error {
+	if g.cancel != nil {
+		g.cancel()
+	}
+	var err error
+	if g.pinger != nil {
+		err = multierr.Append(err, g.pinger.Close())
+	}
+	g.wg.Wait()
+	return err
+}
+
 /*** Constructors ***/
 func New(cfg Config, log Logger, pinger Pinger) Gopinger {
 	return &goping{
 		cfg:    cfg,
 		log:    log,
 		pinger: pinger,
+		stats:  make(map[uint64]*statAccumulator),
 	}
 }
\ No newline at end of file
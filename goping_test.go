@@ -0,0 +1,231 @@
+package goping
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+//nopLogger discards everything; these tests assert on Responses, not logs.
+type nopLogger struct{}
+
+func (nopLogger) Warn(fmt string, v ...interface{})   {}
+func (nopLogger) Info(fmt string, v ...interface{})   {}
+func (nopLogger) Severe(fmt string, v ...interface{}) {}
+func (nopLogger) IsDebug() bool                       { return false }
+func (nopLogger) Debug(fmt string, v ...interface{})  {}
+
+//stubPinger replies to every Ping immediately with the same RawResponse,
+//without touching the network.
+type stubPinger struct {
+	resp RawResponse
+}
+
+func (s *stubPinger) Ping(ctx context.Context, r Request) (<-chan RawResponse, int, error) {
+	future := make(chan RawResponse, 1)
+	future <- s.resp
+	return future, int(r.Sent), nil
+}
+
+func (s *stubPinger) Close() error { return nil }
+
+//sequencedPinger replies with responses[i] on the i-th call, holding at the
+//last entry once exhausted, for tests that need the RawResponse to change
+//across a Request's iterations (e.g. a traceroute reaching its target).
+type sequencedPinger struct {
+	responses []RawResponse
+	i         int
+}
+
+func (s *sequencedPinger) Ping(ctx context.Context, r Request) (<-chan RawResponse, int, error) {
+	resp := s.responses[s.i]
+	if s.i < len(s.responses)-1 {
+		s.i++
+	}
+	future := make(chan RawResponse, 1)
+	future <- resp
+	return future, int(r.Sent), nil
+}
+
+func (s *sequencedPinger) Close() error { return nil }
+
+//recvAll reads n Responses off out, failing the test if any one takes
+//longer than a second to arrive.
+func recvAll(t *testing.T, out <-chan Response, n int) []Response {
+	t.Helper()
+	resps := make([]Response, 0, n)
+	for i := 0; i < n; i++ {
+		select {
+		case r := <-out:
+			resps = append(resps, r)
+		case <-time.After(time.Second):
+			t.Fatalf("timed out waiting for response %d/%d", i+1, n)
+		}
+	}
+	return resps
+}
+
+//TestTracerouteStopsOnEchoReply proves a traceroute Request terminates
+//(Response.Final) as soon as the destination answers, rather than running
+//on to Config.Count.
+func TestTracerouteStopsOnEchoReply(t *testing.T) {
+	timeExceeded := RawResponse{ICMPMessage: icmp.Message{Type: ipv4.ICMPTypeTimeExceeded}}
+	echoReply := RawResponse{ICMPMessage: icmp.Message{Type: ipv4.ICMPTypeEchoReply}}
+	sp := &sequencedPinger{responses: []RawResponse{timeExceeded, timeExceeded, echoReply}}
+
+	cfg := Config{Count: 100, Timeout: time.Second, Traceroute: true, MaxHops: 30, Probes: 1}
+	g := New(cfg, nopLogger{}, sp)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	in, out := g.Start(ctx)
+	in <- g.NewRequest("127.0.0.1", nil)
+
+	resps := recvAll(t, out, 3)
+	for i, r := range resps[:2] {
+		if r.Final {
+			t.Fatalf("response %d finished early, before the EchoReply", i)
+		}
+	}
+	if !resps[2].Final {
+		t.Fatalf("expected the EchoReply response to be Final despite Count=100")
+	}
+}
+
+//TestTracerouteStopsAtMaxHops proves a traceroute that never reaches its
+//destination still terminates once every probe for the last hop has gone
+//unanswered, instead of running to Config.Count.
+func TestTracerouteStopsAtMaxHops(t *testing.T) {
+	timeExceeded := RawResponse{ICMPMessage: icmp.Message{Type: ipv4.ICMPTypeTimeExceeded}}
+	sp := &sequencedPinger{responses: []RawResponse{timeExceeded}}
+
+	cfg := Config{Count: 100, Timeout: time.Second, Traceroute: true, MaxHops: 2, Probes: 1}
+	g := New(cfg, nopLogger{}, sp)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	in, out := g.Start(ctx)
+	in <- g.NewRequest("127.0.0.1", nil)
+
+	resps := recvAll(t, out, 2)
+	if resps[0].Final {
+		t.Fatalf("response 1 finished before MaxHops was exhausted")
+	}
+	if !resps[1].Final {
+		t.Fatalf("expected Final once MaxHops probes are exhausted, got %+v", resps[1])
+	}
+}
+
+//TestGopingStartDeliversResponsesAndStatistics drives a full Gopinger
+//through Start/Ping end to end: Count iterations of a Request should each
+//produce a Response, with Statistics attached to the last one.
+func TestGopingStartDeliversResponsesAndStatistics(t *testing.T) {
+	g := New(Config{Count: 3, Timeout: time.Second}, nopLogger{}, &stubPinger{
+		resp: RawResponse{RTT: 1.5, ICMPMessage: icmp.Message{Type: ipv4.ICMPTypeEchoReply}},
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	in, out := g.Start(ctx)
+	in <- g.NewRequest("127.0.0.1", nil)
+
+	resps := recvAll(t, out, 3)
+	last := resps[2]
+
+	if !last.Final {
+		t.Fatalf("expected the 3rd response to be Final, got %+v", last)
+	}
+	if last.Statistics.PacketsSent != 3 || last.Statistics.PacketsRecv != 3 {
+		t.Fatalf("Statistics = %+v, want 3 sent/3 recv", last.Statistics)
+	}
+	for _, r := range resps {
+		if r.Err != nil {
+			t.Fatalf("unexpected Err: %v", r.Err)
+		}
+	}
+}
+
+//TestGopingClassifiesRawResponses drives Start with a scripted RawResponse
+//per case, covering both IPv4 and IPv6 ICMP types, the Pinger-level Err
+//passthrough, and the Traceroute-dependent TimeExceeded handling.
+func TestGopingClassifiesRawResponses(t *testing.T) {
+	cases := []struct {
+		name       string
+		raw        RawResponse
+		traceroute bool
+		wantErr    bool
+		wantFrag   bool
+	}{
+		{"v4 echo reply", RawResponse{ICMPMessage: icmp.Message{Type: ipv4.ICMPTypeEchoReply}}, false, false, false},
+		{"v6 echo reply", RawResponse{ICMPMessage: icmp.Message{Type: ipv6.ICMPTypeEchoReply}}, false, false, false},
+		{"destination unreachable", RawResponse{ICMPMessage: icmp.Message{Type: ipv4.ICMPTypeDestinationUnreachable, Code: 1}}, false, true, false},
+		{"fragmentation needed", RawResponse{ICMPMessage: icmp.Message{Type: ipv4.ICMPTypeDestinationUnreachable, Code: icmpv4FragNeededCode}, NextHopMTU: 1400}, false, true, true},
+		{"time exceeded, plain ping", RawResponse{ICMPMessage: icmp.Message{Type: ipv4.ICMPTypeTimeExceeded}}, false, true, false},
+		{"time exceeded, traceroute", RawResponse{ICMPMessage: icmp.Message{Type: ipv6.ICMPTypeTimeExceeded}}, true, false, false},
+		{"pinger-level error", RawResponse{Err: errors.New("could not resolve hostname")}, false, true, false},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := Config{Count: 1, Timeout: time.Second, Traceroute: tc.traceroute}
+			g := New(cfg, nopLogger{}, &stubPinger{resp: tc.raw})
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			in, out := g.Start(ctx)
+			in <- g.NewRequest("127.0.0.1", nil)
+			resp := recvAll(t, out, 1)[0]
+
+			if (resp.Err != nil) != tc.wantErr {
+				t.Fatalf("Err = %v, wantErr = %v", resp.Err, tc.wantErr)
+			}
+			if tc.wantFrag {
+				var frag *ErrFragmentationNeeded
+				if !errors.As(resp.Err, &frag) {
+					t.Fatalf("expected *ErrFragmentationNeeded, got %v", resp.Err)
+				}
+			}
+		})
+	}
+}
+
+//TestCloseWaitsForOutstandingRequests is a regression test for Close():
+//it must block until every in-flight request goroutine has observed the
+//cancellation and called g.wg.Done, not return as soon as ctx is canceled.
+func TestCloseWaitsForOutstandingRequests(t *testing.T) {
+	g := New(Config{}, nopLogger{}, &stubPinger{}).(*goping)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	g.Start(ctx)
+
+	g.wg.Add(1)
+	release := make(chan struct{})
+	go func() {
+		<-release
+		g.wg.Done()
+	}()
+
+	closed := make(chan struct{})
+	go func() {
+		g.Close()
+		close(closed)
+	}()
+
+	select {
+	case <-closed:
+		t.Fatal("Close returned before the outstanding request finished")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(release)
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("Close did not return after the outstanding request finished")
+	}
+}
@@ -1,75 +1,394 @@
 package ggping
 
 import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
 	"fmt"
-	"log"
 	"net"
-	"os"
+	"sync"
+	"syscall"
 	"time"
 
+	"go.uber.org/multierr"
 	"golang.org/x/net/icmp"
 	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+	"golang.org/x/sys/unix"
+
+	"github.com/gracig/goping"
 )
 
+//pingMagic tags the payload of echoes we send so we can tell them apart
+//from whatever another process on the same host might be pinging with, and
+//decode our embedded send timestamp back out of a reply.
+var pingMagic = [4]byte{0x67, 0x70, 0x6e, 0x67} // "gpng"
+
+//payloadLen is the magic prefix plus an 8-byte monotonic send timestamp.
+const payloadLen = len(pingMagic) + 8
+
+//clockBase anchors the embedded send timestamps: they are stored as the time
+//elapsed since clockBase, so decodeSendTime returns a time.Time that carries
+//a monotonic clock reading.
+var clockBase = time.Now()
+
+//buildPayload stamps the current time into the Echo payload so the RTT can
+//later be computed from the reply itself, which carries the timestamp back
+//to us. The payload is padded with zero bytes up to size, which lets a
+//caller drive PMTU discovery by growing Ping.PacketSize; size smaller than
+//the timestamp itself is bumped up to fit it.
+func buildPayload(size int) []byte {
+	if size < payloadLen {
+		size = payloadLen
+	}
+	b := make([]byte, size)
+	copy(b, pingMagic[:])
+	binary.BigEndian.PutUint64(b[len(pingMagic):payloadLen], uint64(time.Since(clockBase)))
+	return b
+}
+
+//decodeSendTime reverses buildPayload, reporting ok=false if data doesn't
+//carry our magic (e.g. a reply to some other process's ping).
+func decodeSendTime(data []byte) (t time.Time, ok bool) {
+	if len(data) < payloadLen || !bytes.Equal(data[:len(pingMagic)], pingMagic[:]) {
+		return time.Time{}, false
+	}
+	return clockBase.Add(time.Duration(binary.BigEndian.Uint64(data[len(pingMagic):payloadLen]))), true
+}
+
+//randomID picks the 16-bit ICMP echo ID a Coordinator tags all of its
+//requests with, via crypto/rand rather than os.Getpid(), so that multiple
+//Coordinators in the same process (or PID reuse across hosts sharing a
+//network namespace) don't collide.
+func randomID() (int, error) {
+	var b [2]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return 0, fmt.Errorf("could not generate a random icmp echo id: %v", err)
+	}
+	return int(binary.BigEndian.Uint16(b[:])), nil
+}
+
+//network keys used to address the per-family connections
+const (
+	networkIPv4 = "ip4:icmp"
+	networkIPv6 = "ip6:ipv6-icmp"
+
+	//unprivileged (SOCK_DGRAM) equivalents, used when NewCoordinator's unprivileged is set
+	networkUDP4 = "udp4"
+	networkUDP6 = "udp6"
+)
+
+//protocol numbers expected by icmp.ParseMessage for each family
+const (
+	protoICMP   = 1
+	protoICMPv6 = 58
+)
+
+//icmpv4FragNeededCode is the IPv4 Destination Unreachable code meaning
+//"fragmentation needed and DF was set" (RFC 1191).
+const icmpv4FragNeededCode = 4
+
+//ipv4Conn returns a *ipv4.PacketConn usable for control messages and socket
+//options (TTL, TOS, ...) out of the connection a ListenPacketer handed
+//back. A *icmp.PacketConn (what netListenPacketer returns for the
+//unprivileged "udp4"/"udp6" networks) already wraps one internally and must
+//be unwrapped rather than re-wrapped: ipv4.NewPacketConn panics on it, since
+//it isn't itself a net.Conn. Any other net.PacketConn (e.g. one injected by
+//a test, or the *net.IPConn netListenPacketer returns for raw sockets) is
+//wrapped directly.
+func ipv4Conn(c net.PacketConn) *ipv4.PacketConn {
+	if ic, ok := c.(*icmp.PacketConn); ok {
+		return ic.IPv4PacketConn()
+	}
+	return ipv4.NewPacketConn(c)
+}
+
+//ipv6Conn is ipv4Conn's IPv6 counterpart.
+func ipv6Conn(c net.PacketConn) *ipv6.PacketConn {
+	if ic, ok := c.(*icmp.PacketConn); ok {
+		return ic.IPv6PacketConn()
+	}
+	return ipv6.NewPacketConn(c)
+}
+
+//setDontFragment sets or clears the IPv4 Don't Fragment flag on c's
+//outbound packets via the IP_MTU_DISCOVER socket option, so Ping.DontFragment
+//can drive Path MTU discovery. It needs raw access to the socket's file
+//descriptor (syscall.Conn); netListenPacketer's raw-socket connections
+//expose one, but a caller-injected ListenPacketer might not. sendMessage4
+//ignores an error when clearing the flag, and fails the probe with it when
+//Ping.DontFragment is set.
+func setDontFragment(c net.PacketConn, dontFragment bool) error {
+	sc, ok := c.(syscall.Conn)
+	if !ok {
+		return fmt.Errorf("connection does not support setting the don't fragment flag")
+	}
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		return err
+	}
+	mode := unix.IP_PMTUDISC_WANT
+	if dontFragment {
+		mode = unix.IP_PMTUDISC_DO
+	}
+	var sockErr error
+	if ctlErr := rc.Control(func(fd uintptr) {
+		sockErr = unix.SetsockoptInt(int(fd), unix.IPPROTO_IP, unix.IP_MTU_DISCOVER, mode)
+	}); ctlErr != nil {
+		return ctlErr
+	}
+	return sockErr
+}
+
+//ListenPacketer abstracts the creation of the socket used to send and
+//receive ICMP packets. Consumers can inject their own implementation to
+//bind to a specific netns, source interface, or mock it in tests.
+type ListenPacketer interface {
+	ListenPacket(network, address string) (net.PacketConn, error)
+}
+
+//netListenPacketer is the default ListenPacketer. For the unprivileged
+//"udp4"/"udp6" (SOCK_DGRAM) sockets it delegates to icmp.ListenPacket, as
+//described by the golang.org/x/net/icmp examples. For the raw "ip4:icmp"/
+//"ip6:ipv6-icmp" sockets it calls net.ListenPacket directly instead: for
+//that network, icmp.ListenPacket just forwards to net.ListenPacket and
+//wraps the result in a *icmp.PacketConn that only exposes net.PacketConn,
+//hiding the syscall.Conn setDontFragment needs to reach the fd's
+//IP_MTU_DISCOVER option. Calling net.ListenPacket ourselves gets us the
+//same underlying connection without that wrapper in the way.
+type netListenPacketer struct{}
+
+func (netListenPacketer) ListenPacket(network, address string) (net.PacketConn, error) {
+	if network == networkIPv4 || network == networkIPv6 {
+		return net.ListenPacket(network, address)
+	}
+	c, err := icmp.ListenPacket(network, address)
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
 type Ping struct {
-	To          string
-	Timeout     uint
-	EchoMap     map[string]string
-	When        time.Time
-	Seq         int
-	Pong        Pong
-	EchoChannel chan *Ping
+	To           string
+	Timeout      uint
+	EchoMap      map[string]string
+	When         time.Time
+	Seq          int
+	Pong         Pong
+	EchoChannel  chan *Ping
+	Unprivileged bool //not read by the Coordinator: raw vs. udp4/udp6 sockets are fixed by NewCoordinator's unprivileged argument
+	TTL          int  //if >0, set as the IPv4 TTL/IPv6 hop limit of the outbound packet; used for traceroute probes
+	TOS          int  //IPv4 type-of-service set on the outbound packet via ipv4.PacketConn.SetTOS; ignored for IPv6 and on unprivileged sockets
+	PacketSize   int  //total size in bytes of the Echo payload; 0 falls back to the minimum needed for the embedded timestamp
+	DontFragment bool //set the IPv4 header's Don't Fragment flag, for Path MTU discovery; ignored for IPv6 and on unprivileged sockets
 
 	pongchan chan *rawIcmp
 }
 
 type Pong struct {
-	Rtt float64
-	Err error
+	Rtt        float64
+	Err        error
+	From       net.IP    //the address that answered: the destination for an EchoReply, a hop's router for a TimeExceeded
+	TTL        int       //echoes back Ping.TTL, so a traceroute caller can label the hop
+	NextHopMTU int       //the MTU reported by a fragmentation-needed reply; 0 otherwise
+	ICMPType   icmp.Type //the matched reply's ICMP type, e.g. ipv4.ICMPTypeEchoReply or ipv4.ICMPTypeTimeExceeded
+	ICMPCode   int
 }
 
-func runListener(handleRawIcmp func(ri *rawIcmp)) {
-	//Creates the connection to send and receive packets
-	c, err := net.ListenPacket("ip4:1", "0.0.0.0")
+//Coordinator sends Pings over a pair of ICMP sockets (one per address
+//family) and demultiplexes the replies back to their caller. Close() shuts
+//it down and releases both sockets.
+type Coordinator struct {
+	log   goping.Logger
+	conns map[string]net.PacketConn
+	id    int //random 16-bit ICMP echo ID tagging every Ping this Coordinator sends
+
+	ping chan Ping
+
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+//NewCoordinator opens the IPv4 and IPv6 sockets (raw, or unprivileged
+//datagram sockets when unprivileged is set) through lp and starts serving
+//Pings sent to the returned channel.
+func NewCoordinator(lp ListenPacketer, unprivileged bool, log goping.Logger, pongBuffer int) (*Coordinator, error) {
+	conns, err := listen(lp, unprivileged)
+	if err != nil {
+		return nil, err
+	}
+
+	id, err := randomID()
 	if err != nil {
-		log.Fatal("Could not open raw socket ip4:icmp: %v", err)
+		for _, c := range conns {
+			c.Close()
+		}
+		return nil, err
 	}
-	//defer c.Close()
-	p := ipv4.NewPacketConn(c)
-	if err := p.SetControlMessage(ipv4.FlagTTL|ipv4.FlagSrc|ipv4.FlagDst|ipv4.FlagInterface, true); err != nil {
-		log.Fatal(err)
+
+	co := &Coordinator{
+		log:   log,
+		conns: conns,
+		id:    id,
+		ping:  make(chan Ping),
+		done:  make(chan struct{}),
 	}
 
-	for {
-		//Reads an ICMP Message from the Socket.
-		ri := rawIcmp{bytes: make([]byte, 1500)}
-		if ri.size, ri.cm, ri.peer, ri.err = p.ReadFrom(ri.bytes); ri.err != nil {
-			log.Fatal("Could not read from socket: %v", ri.err)
+	go co.run(unprivileged, pongBuffer)
+
+	return co, nil
+}
+
+//Ping returns the channel used to submit Ping requests to the Coordinator.
+func (co *Coordinator) Ping() chan<- Ping {
+	return co.ping
+}
+
+//Close stops the Coordinator, closes both underlying sockets (which
+//unblocks their in-flight ReadFrom calls) and reports any error
+//encountered while doing so.
+func (co *Coordinator) Close() error {
+	var err error
+	co.closeOnce.Do(func() {
+		close(co.done)
+		for network, c := range co.conns {
+			if cerr := c.Close(); cerr != nil {
+				err = multierr.Append(err, fmt.Errorf("closing %s socket: %v", network, cerr))
+			}
+		}
+	})
+	return err
+}
+
+//rawNetwork returns the socket network to dial for a family, honoring
+//unprivileged.
+func rawNetwork(family string, unprivileged bool) string {
+	switch {
+	case family == networkIPv4 && unprivileged:
+		return networkUDP4
+	case family == networkIPv6 && unprivileged:
+		return networkUDP6
+	default:
+		return family
+	}
+}
+
+//listen opens one connection per address family and returns them keyed by
+//the logical family (networkIPv4, networkIPv6), regardless of whether the
+//underlying socket ended up being raw or unprivileged (datagram).
+func listen(lp ListenPacketer, unprivileged bool) (map[string]net.PacketConn, error) {
+	conns := make(map[string]net.PacketConn, 2)
+
+	c4, err := lp.ListenPacket(rawNetwork(networkIPv4, unprivileged), "0.0.0.0")
+	if err != nil {
+		return nil, fmt.Errorf("could not open socket %s: %v", rawNetwork(networkIPv4, unprivileged), err)
+	}
+	conns[networkIPv4] = c4
+
+	c6, err := lp.ListenPacket(rawNetwork(networkIPv6, unprivileged), "::")
+	if err != nil {
+		c4.Close()
+		return nil, fmt.Errorf("could not open socket %s: %v", rawNetwork(networkIPv6, unprivileged), err)
+	}
+	conns[networkIPv6] = c6
+
+	return conns, nil
+}
+
+//runListenerOn reads ICMP messages off a single, already address-family
+//specific connection and forwards them to handleRawIcmp. It returns once
+//the connection is closed (by Coordinator.Close), logging any other read
+//error through log instead of crashing the process. In unprivileged mode
+//the connection is a plain datagram socket: the kernel strips the IP
+//header for us, so there is no ipv4/ipv6 control message to request.
+func runListenerOn(network string, c net.PacketConn, unprivileged bool, log goping.Logger, done <-chan struct{}, handleRawIcmp func(ri *rawIcmp)) {
+	proto := protoICMP
+	if network == networkIPv6 {
+		proto = protoICMPv6
+	}
+
+	if unprivileged {
+		for {
+			ri := rawIcmp{network: network, proto: proto, bytes: make([]byte, 1500)}
+			ri.size, ri.peer, ri.err = c.ReadFrom(ri.bytes)
+			if ri.err != nil {
+				logReadError(log, done, network, ri.err)
+				return
+			}
+			ri.when = time.Now()
+			go func(r rawIcmp) { handleRawIcmp(&r) }(ri)
+		}
+	}
+
+	if network == networkIPv4 {
+		p := ipv4Conn(c)
+		if err := p.SetControlMessage(ipv4.FlagTTL|ipv4.FlagSrc|ipv4.FlagDst|ipv4.FlagInterface, true); err != nil {
+			log.Severe("could not configure %s control messages: %v", network, err)
+			return
+		}
+		for {
+			ri := rawIcmp{network: network, proto: proto, bytes: make([]byte, 1500)}
+			var cm *ipv4.ControlMessage
+			ri.size, cm, ri.peer, ri.err = p.ReadFrom(ri.bytes)
+			if ri.err != nil {
+				logReadError(log, done, network, ri.err)
+				return
+			}
+			ri.when = time.Now()
+			ri.cm = cm
+			go func(r rawIcmp) { handleRawIcmp(&r) }(ri)
 		}
+	}
 
-		//Tags the time when the message arrived. This will be used to calc RTT
+	p := ipv6Conn(c)
+	if err := p.SetControlMessage(ipv6.FlagHopLimit|ipv6.FlagSrc|ipv6.FlagDst|ipv6.FlagInterface, true); err != nil {
+		log.Severe("could not configure %s control messages: %v", network, err)
+		return
+	}
+	for {
+		ri := rawIcmp{network: network, proto: proto, bytes: make([]byte, 1500)}
+		var cm *ipv6.ControlMessage
+		ri.size, cm, ri.peer, ri.err = p.ReadFrom(ri.bytes)
+		if ri.err != nil {
+			logReadError(log, done, network, ri.err)
+			return
+		}
 		ri.when = time.Now()
+		ri.cm = cm
+		go func(r rawIcmp) { handleRawIcmp(&r) }(ri)
+	}
+}
 
-		//Sends the Message to the checho channel
-		go func(r rawIcmp) {
-			handleRawIcmp(&r)
-		}(ri)
+//logReadError only logs a read error as Severe when it wasn't caused by
+//Coordinator.Close shutting the socket down.
+func logReadError(log goping.Logger, done <-chan struct{}, network string, err error) {
+	select {
+	case <-done:
+		//Close() closed the socket to unblock us. Nothing to report.
+	default:
+		log.Severe("could not read from %s socket: %v", network, err)
 	}
 }
-func coordinator(ping chan Ping, pongBuffer int) {
+
+func (co *Coordinator) run(unprivileged bool, pongBuffer int) {
 
 	//Maintains a sequence number
 	var seq int
 
-	//Creates the connection to send and receive packets
-	c, err := net.ListenPacket("ip4:1", "0.0.0.0")
-	if err != nil {
-		log.Fatal("Could not open raw socket ip4:icmp: %v", err)
-	}
-	//defer c.Close()
-	p := ipv4.NewPacketConn(c)
-	if err := p.SetControlMessage(ipv4.FlagTTL|ipv4.FlagSrc|ipv4.FlagDst|ipv4.FlagInterface, true); err != nil {
-		log.Fatal(err)
+	var p4 *ipv4.PacketConn
+	var p6 *ipv6.PacketConn
+	if !unprivileged {
+		p4 = ipv4Conn(co.conns[networkIPv4])
+		p6 = ipv6Conn(co.conns[networkIPv6])
+		if err := p4.SetControlMessage(ipv4.FlagTTL|ipv4.FlagSrc|ipv4.FlagDst|ipv4.FlagInterface, true); err != nil {
+			co.log.Severe("could not configure %s control messages: %v", networkIPv4, err)
+			return
+		}
+		if err := p6.SetControlMessage(ipv6.FlagHopLimit|ipv6.FlagSrc|ipv6.FlagDst|ipv6.FlagInterface, true); err != nil {
+			co.log.Severe("could not configure %s control messages: %v", networkIPv6, err)
+			return
+		}
 	}
 
 	//Creates the handler to receive raw icmp
@@ -78,29 +397,66 @@ func coordinator(ping chan Ping, pongBuffer int) {
 		pong <- ri
 	}
 
-	//Starts the icmp Listener in a goroutine
-	go runListener(icmpRecvHandler)
+	//Starts the icmp listeners in goroutines, one per address family
+	go runListenerOn(networkIPv4, co.conns[networkIPv4], unprivileged, co.log, co.done, icmpRecvHandler)
+	go runListenerOn(networkIPv6, co.conns[networkIPv6], unprivileged, co.log, co.done, icmpRecvHandler)
 
 	//Creates a map to match requests with a channel to send response
 	var pingmap = make(map[int]chan *rawIcmp)
 
 	for {
 		select {
-		case pi := <-ping:
+		case <-co.done:
+			//Close() was called: stop serving new pings. Outstanding ones get
+			//a "coordinator closed" Pong from their own goroutine below.
+			return
+
+		case pi := <-co.ping:
 			//Increment the sequence number and assigns to pi.Seq
 			seq++
 			pi.Seq = seq
 
-			//Send the ping message. On error return the ping to EchoChannel if istantiated
-			if err := sendMessage(&pi, p); err != nil {
+			//Resolves the destination to decide which address family (and
+			//connection) this ping should go through
+			dst, network, err := resolveAddr(pi.To)
+			if err != nil {
 				pi.Pong = Pong{Err: err}
+				if pi.EchoChannel != nil {
+					go func(pi *Ping) { pi.EchoChannel <- pi }(&pi)
+				} else {
+					co.log.Warn("could not resolve ping %v [%v]", pi, err)
+				}
+				break //next select
+			}
+
+			//Send the ping message. On error return the ping to EchoChannel if istantiated
+			var sendErr error
+			switch {
+			case unprivileged && pi.TTL > 0:
+				//sendMessageUDP has no way to stamp a per-packet TTL (the
+				//unprivileged socket is a plain SOCK_DGRAM endpoint with no
+				//accessible control-message path), so a traceroute probe sent
+				//this way would silently go out at the socket's default TTL
+				//instead of the requested hop. Refuse it instead.
+				sendErr = fmt.Errorf("per-probe TTL (traceroute) is not supported on an unprivileged socket")
+			case network == networkIPv4 && unprivileged:
+				sendErr = sendMessageUDP(&pi, co.conns[networkIPv4], ipv4.ICMPTypeEcho, &net.UDPAddr{IP: dst.IP, Zone: dst.Zone})
+			case network == networkIPv4:
+				sendErr = sendMessage4(&pi, co.id, p4, co.conns[networkIPv4], dst)
+			case unprivileged:
+				sendErr = sendMessageUDP(&pi, co.conns[networkIPv6], ipv6.ICMPTypeEchoRequest, &net.UDPAddr{IP: dst.IP, Zone: dst.Zone})
+			default:
+				sendErr = sendMessage6(&pi, co.id, p6, dst)
+			}
+			if sendErr != nil {
+				pi.Pong = Pong{Err: sendErr}
 				if pi.EchoChannel != nil {
 					//Return the ping to the EchoChannel
 					go func(pi *Ping) {
 						pi.EchoChannel <- pi
 					}(&pi)
 				} else {
-					log.Printf("Could not send ping %v [%v]\n", pi, err)
+					co.log.Warn("could not send ping %v [%v]", pi, sendErr)
 				}
 
 				break //next select
@@ -115,9 +471,24 @@ func coordinator(ping chan Ping, pongBuffer int) {
 			go func(pi *Ping) {
 				select {
 				case ri := <-pi.pongchan:
-					pi.Pong = Pong{Rtt: float64(pi.When.Sub(ri.when)) / float64(time.Millisecond)}
-					//case <-time.After(time.Second * time.Duration(pi.Timeout)):
-					//	pi.Pong = Pong{Err: fmt.Errorf("Request Timeout after %v seconds", pi.Timeout)}
+					//Prefer the timestamp we embedded in the payload, which the
+					//reply carries back; pi.When is used only when the payload
+					//doesn't decode. The embedded timestamp is taken when the
+					//message is built, slightly earlier than pi.When.
+					sent := pi.When
+					if t, ok := decodeSendTime(ri.payload); ok {
+						sent = t
+					}
+					pi.Pong = Pong{
+						Rtt:        float64(ri.when.Sub(sent)) / float64(time.Millisecond),
+						From:       addrIP(ri.peer),
+						TTL:        pi.TTL,
+						NextHopMTU: ri.nextHopMTU,
+						ICMPType:   ri.icmpType,
+						ICMPCode:   ri.icmpCode,
+					}
+				case <-co.done:
+					pi.Pong = Pong{Err: fmt.Errorf("coordinator closed")}
 				}
 				if pi.EchoChannel != nil {
 					pi.EchoChannel <- pi
@@ -126,75 +497,239 @@ func coordinator(ping chan Ping, pongBuffer int) {
 
 		case ri := <-pong:
 
-			//Parsing the packet using golang icmp library
-			rm, err := icmp.ParseMessage(1, ri.bytes[:ri.size])
+			//Parsing the packet using golang icmp library, using the
+			//protocol number that matches the family it arrived on
+			rm, err := icmp.ParseMessage(ri.proto, ri.bytes[:ri.size])
 			if err != nil {
-				fmt.Printf("Could not parse message")
+				co.log.Warn("could not parse message: %v", err)
 				break
 			}
+			ri.icmpType = rm.Type
+			ri.icmpCode = rm.Code
 
-			//Testing for the type of icmp message
-			if rm.Type != ipv4.ICMPTypeEchoReply {
-				break
-			}
+			ri.nextHopMTU = fragNeededMTU(rm, ri.bytes[:ri.size])
 
-			//Getting the ICMP Echo Reply
-			body := rm.Body.(*icmp.Echo)
-			if body.ID != os.Getpid() {
-				fmt.Printf("Ignoring packet from external process")
+			//Recovers the sequence number that demultiplexes this reply back
+			//to its Ping: straight from the Echo body for a normal reply, or
+			//from the original datagram embedded in a traceroute hop's
+			//TimeExceeded message. Also stashes the payload we can decode a
+			//send timestamp out of, for the RTT calculation above.
+			matchSeq, ok := demuxSeq(rm, ri, co.id, unprivileged)
+			if !ok {
 				break
 			}
 
 			//Find the ping request in the map and send the packet through its channel
-			if pingmap[seq] != nil {
-				pingmap[seq] <- ri
-				close(pingmap[seq])
-				delete(pingmap, seq)
+			if pingmap[matchSeq] != nil {
+				pingmap[matchSeq] <- ri
+				close(pingmap[matchSeq])
+				delete(pingmap, matchSeq)
 			}
 		}
 	}
 }
 
-type rawIcmp struct {
-	when    time.Time
-	size    int
-	peer    net.Addr
-	bytes   []byte
-	cm      *ipv4.ControlMessage
-	message *icmp.Echo //The message after being parsed
-	err     error
+//fragNeededMTU extracts the next-hop MTU from a code 4 Destination
+//Unreachable ("fragmentation needed") message: RFC 1191 places it at bytes
+//6:8 of the raw ICMP header, a field icmp.ParseMessage discards when it
+//builds the generic DstUnreach body. raw is the full received datagram,
+//rm its already-parsed form. Returns 0 for anything else.
+func fragNeededMTU(rm *icmp.Message, raw []byte) int {
+	if rm.Type != ipv4.ICMPTypeDestinationUnreachable || rm.Code != icmpv4FragNeededCode || len(raw) < 8 {
+		return 0
+	}
+	return int(binary.BigEndian.Uint16(raw[6:8]))
+}
+
+//demuxSeq recovers the sequence number to look up in pingmap out of an
+//incoming ICMP message: directly from an Echo reply's body, or from the
+//original echo request embedded in a traceroute hop's TimeExceeded message.
+//On a raw socket a reply is only matched by (id, seq) together, never by
+//seq alone, so a stray reply to someone else's ping on the same socket can't
+//be mistaken for ours; in unprivileged mode it is matched by seq alone. As a side effect it stashes the matched message's
+//payload in ri.payload, for decodeSendTime to read the RTT timestamp out of.
+func demuxSeq(rm *icmp.Message, ri *rawIcmp, id int, unprivileged bool) (seq int, ok bool) {
+	switch body := rm.Body.(type) {
+	case *icmp.Echo:
+		if rm.Type != ipv4.ICMPTypeEchoReply && rm.Type != ipv6.ICMPTypeEchoReply {
+			return 0, false
+		}
+		//In privileged (raw socket) mode, several processes share the same
+		//socket, so replies are filtered by the echo ID we stamped them
+		//with. In unprivileged mode the kernel assigns (and rewrites) the
+		//echo ID itself and already demultiplexes replies to the socket
+		//that sent the matching request.
+		if !unprivileged && body.ID != id {
+			return 0, false
+		}
+		ri.payload = body.Data
+		return body.Seq, true
+
+	case *icmp.TimeExceeded:
+		if rm.Type != ipv4.ICMPTypeTimeExceeded && rm.Type != ipv6.ICMPTypeTimeExceeded {
+			return 0, false
+		}
+		return embeddedEcho(ri.network, body.Data, id, unprivileged, ri)
+
+	default:
+		return 0, false
+	}
+}
+
+//embeddedEcho pulls the id/Seq/payload out of the echo request that a
+//router quotes back inside a TimeExceeded message: the original IP header
+//followed by the first 8 bytes of the original ICMP echo (type, code,
+//checksum, id, seq) and then whatever payload bytes the router bothered to
+//quote.
+func embeddedEcho(network string, data []byte, id int, unprivileged bool, ri *rawIcmp) (seq int, ok bool) {
+	ipHeaderLen := 20
+	if network == networkIPv6 {
+		ipHeaderLen = 40
+	}
+	if len(data) < ipHeaderLen+8 {
+		return 0, false
+	}
+	echo := data[ipHeaderLen:]
+	echoID := int(echo[4])<<8 | int(echo[5])
+	if !unprivileged && echoID != id {
+		return 0, false
+	}
+	ri.payload = echo[8:]
+	return int(echo[6])<<8 | int(echo[7]), true
 }
 
-func sendMessage(pi *Ping, p *ipv4.PacketConn) error {
+//addrIP extracts the net.IP out of the net.Addr types ReadFrom can hand
+//back (*net.IPAddr for raw sockets, *net.UDPAddr for unprivileged ones).
+func addrIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.IPAddr:
+		return a.IP
+	case *net.UDPAddr:
+		return a.IP
+	default:
+		return nil
+	}
+}
 
-	//Tries to convert the To attribute into an Ip attribute
-	dst, err := net.ResolveIPAddr("ip4", pi.To)
+//resolveAddr resolves host to an IP address and reports which network
+//(networkIPv4/networkIPv6) should carry the ping.
+func resolveAddr(host string) (*net.IPAddr, string, error) {
+	addr, err := net.ResolveIPAddr("ip", host)
 	if err != nil {
-		return fmt.Errorf("Could not resolve hostname: %v", pi.To)
+		return nil, "", fmt.Errorf("could not resolve hostname: %v", host)
 	}
+	if addr.IP.To4() != nil {
+		return addr, networkIPv4, nil
+	}
+	return addr, networkIPv6, nil
+}
 
-	//Creates the message to be sent based on Ping parameters
+type rawIcmp struct {
+	network    string //networkIPv4 or networkIPv6, the family this message arrived on
+	proto      int    //protoICMP or protoICMPv6, passed to icmp.ParseMessage
+	when       time.Time
+	size       int
+	peer       net.Addr
+	bytes      []byte
+	cm         interface{} //*ipv4.ControlMessage or *ipv6.ControlMessage, nil in unprivileged mode
+	payload    []byte      //the matched echo's payload, set by demuxSeq; decodeSendTime reads the RTT timestamp out of it
+	nextHopMTU int         //set for a code 4 Destination Unreachable; 0 otherwise
+	icmpType   icmp.Type   //the parsed message's ICMP type, stashed for Pong.ICMPType
+	icmpCode   int
+	err        error
+}
+
+func sendMessage4(pi *Ping, id int, p *ipv4.PacketConn, rawConn net.PacketConn, dst *net.IPAddr) error {
 	wm := icmp.Message{
 		Type: ipv4.ICMPTypeEcho,
 		Code: 0,
 		Body: &icmp.Echo{
-			ID:   os.Getpid() & 0xffff,
-			Data: []byte("HELLO-R-U-THERE"),
+			ID:   id,
+			Seq:  pi.Seq,
+			Data: buildPayload(pi.PacketSize),
+		},
+	}
+
+	wb, err := wm.Marshal(nil)
+	if err != nil {
+		return fmt.Errorf("could not marshal the icmp message")
+	}
+
+	//TOS and the don't-fragment flag are socket-wide options on the shared
+	//per-family PacketConn, not per-packet ones: they must always be driven
+	//to pi's actual value, including the zero/false case, or a prior probe's
+	//setting (e.g. a PMTU probe) would silently leak onto this one.
+	if err := p.SetTOS(pi.TOS); err != nil {
+		return fmt.Errorf("could not set tos: %v", err)
+	}
+	if err := setDontFragment(rawConn, pi.DontFragment); err != nil && pi.DontFragment {
+		return fmt.Errorf("could not set don't fragment flag: %v", err)
+	}
+
+	//A non-zero TTL (a fixed Config.TTL, or a traceroute probe's hop) is
+	//stamped on this packet only, since concurrent probes on the same
+	//PacketConn may be carrying different TTLs.
+	var cm *ipv4.ControlMessage
+	if pi.TTL > 0 {
+		cm = &ipv4.ControlMessage{TTL: pi.TTL}
+	}
+
+	pi.When = time.Now()
+	if _, err := p.WriteTo(wb, cm, dst); err != nil {
+		return fmt.Errorf("could not send message through network")
+	}
+	return nil
+}
+
+func sendMessage6(pi *Ping, id int, p *ipv6.PacketConn, dst *net.IPAddr) error {
+	wm := icmp.Message{
+		Type: ipv6.ICMPTypeEchoRequest,
+		Code: 0,
+		Body: &icmp.Echo{
+			ID:   id,
+			Seq:  pi.Seq,
+			Data: buildPayload(pi.PacketSize),
+		},
+	}
+
+	wb, err := wm.Marshal(nil)
+	if err != nil {
+		return fmt.Errorf("could not marshal the icmp message")
+	}
+
+	var cm *ipv6.ControlMessage
+	if pi.TTL > 0 {
+		cm = &ipv6.ControlMessage{HopLimit: pi.TTL}
+	}
+
+	pi.When = time.Now()
+	if _, err := p.WriteTo(wb, cm, dst); err != nil {
+		return fmt.Errorf("could not send message through network")
+	}
+	return nil
+}
+
+//sendMessageUDP sends an echo request over an unprivileged (SOCK_DGRAM)
+//ICMP socket. The destination is a *net.UDPAddr and the echo ID is left
+//for the kernel to assign, per net.ipv4.ping_group_range semantics.
+func sendMessageUDP(pi *Ping, c net.PacketConn, t icmp.Type, dst *net.UDPAddr) error {
+	wm := icmp.Message{
+		Type: t,
+		Code: 0,
+		Body: &icmp.Echo{
+			Seq:  pi.Seq,
+			Data: buildPayload(pi.PacketSize),
 		},
 	}
-	//Sets the Sequence of the Message
-	wm.Body.(*icmp.Echo).Seq = pi.Seq
 
-	//Serialize the message in a binary format
 	wb, err := wm.Marshal(nil)
 	if err != nil {
-		return fmt.Errorf("Could not Marshall the icmp message")
+		return fmt.Errorf("could not marshal the icmp message")
 	}
 
-	//Writes the message into the socket
 	pi.When = time.Now()
-	if _, err := p.WriteTo(wb, nil, dst); err != nil {
-		return fmt.Errorf("Could not send message through network")
+	if _, err := c.WriteTo(wb, dst); err != nil {
+		return fmt.Errorf("could not send message through network")
 	}
 	return nil
 }
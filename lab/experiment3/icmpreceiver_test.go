@@ -0,0 +1,254 @@
+package ggping
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"reflect"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+)
+
+//testLogger discards everything; the tests below don't assert on log
+//output, only on behavior.
+type testLogger struct{}
+
+func (testLogger) Warn(fmt string, v ...interface{})   {}
+func (testLogger) Info(fmt string, v ...interface{})   {}
+func (testLogger) Severe(fmt string, v ...interface{}) {}
+func (testLogger) IsDebug() bool                       { return false }
+func (testLogger) Debug(fmt string, v ...interface{})  {}
+
+//fakePacketConn is a net.PacketConn (and net.Conn, since ipv4Conn falls
+//back to wrapping one as such for anything that isn't a *icmp.PacketConn)
+//that never produces a packet: its reads block until Close, which is
+//enough to let a Coordinator's listener goroutines start and exit cleanly
+//without touching a real socket.
+type fakePacketConn struct {
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+func newFakePacketConn() *fakePacketConn {
+	return &fakePacketConn{closed: make(chan struct{})}
+}
+
+func (f *fakePacketConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	<-f.closed
+	return 0, nil, net.ErrClosed
+}
+
+func (f *fakePacketConn) Read(p []byte) (int, error) {
+	<-f.closed
+	return 0, net.ErrClosed
+}
+
+func (f *fakePacketConn) WriteTo(p []byte, addr net.Addr) (int, error) { return len(p), nil }
+func (f *fakePacketConn) Write(p []byte) (int, error)                  { return len(p), nil }
+
+func (f *fakePacketConn) Close() error {
+	f.closeOnce.Do(func() { close(f.closed) })
+	return nil
+}
+
+func (f *fakePacketConn) LocalAddr() net.Addr               { return &net.IPAddr{} }
+func (f *fakePacketConn) RemoteAddr() net.Addr              { return &net.IPAddr{} }
+func (f *fakePacketConn) SetDeadline(t time.Time) error     { return nil }
+func (f *fakePacketConn) SetReadDeadline(t time.Time) error { return nil }
+func (f *fakePacketConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+//mockListenPacketer records the network each ListenPacket call asked for,
+//so a test can assert on which sockets a Coordinator opens without ever
+//touching a real one.
+type mockListenPacketer struct {
+	mu       sync.Mutex
+	networks []string
+}
+
+func (m *mockListenPacketer) ListenPacket(network, address string) (net.PacketConn, error) {
+	m.mu.Lock()
+	m.networks = append(m.networks, network)
+	m.mu.Unlock()
+	return newFakePacketConn(), nil
+}
+
+//TestCoordinatorUnprivilegedSelectsDatagramSockets exercises the mocking
+//rationale ListenPacketer was introduced for: a Coordinator asks for raw
+//ip4:icmp/ip6:ipv6-icmp sockets by default, and udp4/udp6 datagram sockets
+//when told to run unprivileged.
+func TestCoordinatorUnprivilegedSelectsDatagramSockets(t *testing.T) {
+	for _, tc := range []struct {
+		name         string
+		unprivileged bool
+		want         []string
+	}{
+		{"privileged", false, []string{networkIPv4, networkIPv6}},
+		{"unprivileged", true, []string{networkUDP4, networkUDP6}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			lp := &mockListenPacketer{}
+			co, err := NewCoordinator(lp, tc.unprivileged, testLogger{}, 1)
+			if err != nil {
+				t.Fatalf("NewCoordinator: %v", err)
+			}
+			defer co.Close()
+
+			lp.mu.Lock()
+			got := append([]string(nil), lp.networks...)
+			lp.mu.Unlock()
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("ListenPacket networks = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+//TestDemuxSeqMatchesByIDAndSeq is a regression test for the bug the
+//(id, seq) demux rewrite fixed: matching a reply by Seq alone, the way the
+//original pingmap[seq] lookup did, lets a reply addressed to a different
+//process sharing the same raw socket be mistaken for ours whenever the two
+//pings happen to collide on Seq.
+func TestDemuxSeqMatchesByIDAndSeq(t *testing.T) {
+	const ourID = 42
+	const otherID = 99
+	const seq = 7
+
+	echoReply := func(id int) *icmp.Message {
+		return &icmp.Message{
+			Type: ipv4.ICMPTypeEchoReply,
+			Code: 0,
+			Body: &icmp.Echo{ID: id, Seq: seq, Data: []byte("payload")},
+		}
+	}
+
+	if gotSeq, ok := demuxSeq(echoReply(ourID), &rawIcmp{network: networkIPv4}, ourID, false); !ok || gotSeq != seq {
+		t.Fatalf("reply to our own id: got (%d, %v), want (%d, true)", gotSeq, ok, seq)
+	}
+
+	if _, ok := demuxSeq(echoReply(otherID), &rawIcmp{network: networkIPv4}, ourID, false); ok {
+		t.Fatalf("matched a reply addressed to a different id just because Seq collided")
+	}
+
+	//In unprivileged mode the kernel demultiplexes by socket before we ever
+	//see the packet, so the id it stamps on the reply is irrelevant to us.
+	if gotSeq, ok := demuxSeq(echoReply(otherID), &rawIcmp{network: networkIPv4}, ourID, true); !ok || gotSeq != seq {
+		t.Fatalf("unprivileged: got (%d, %v), want (%d, true)", gotSeq, ok, seq)
+	}
+}
+
+//TestEmbeddedEchoParsesTraceroute exercises embeddedEcho and demuxSeq's
+//TimeExceeded branch against a synthetic traceroute hop reply: a quoted
+//IPv4 header followed by the first 8 bytes of our original echo and
+//whatever payload the router echoed back.
+func TestEmbeddedEchoParsesTraceroute(t *testing.T) {
+	const wantID = 0x1234
+	const wantSeq = 0x0203
+	payload := []byte("gpng-traceroute-payload")
+
+	echo := make([]byte, 8+len(payload))
+	binary.BigEndian.PutUint16(echo[4:6], wantID)
+	binary.BigEndian.PutUint16(echo[6:8], wantSeq)
+	copy(echo[8:], payload)
+
+	quoted := append(make([]byte, 20), echo...) //20-byte IPv4 header + echo
+
+	ri := &rawIcmp{network: networkIPv4}
+	gotSeq, ok := embeddedEcho(networkIPv4, quoted, wantID, false, ri)
+	if !ok || gotSeq != wantSeq {
+		t.Fatalf("embeddedEcho: got (%d, %v), want (%d, true)", gotSeq, ok, wantSeq)
+	}
+	if string(ri.payload) != string(payload) {
+		t.Fatalf("embeddedEcho payload = %q, want %q", ri.payload, payload)
+	}
+
+	if _, ok := embeddedEcho(networkIPv4, quoted, wantID+1, false, &rawIcmp{}); ok {
+		t.Fatalf("matched a TimeExceeded quoting a different id")
+	}
+
+	te := &icmp.Message{Type: ipv4.ICMPTypeTimeExceeded, Body: &icmp.TimeExceeded{Data: quoted}}
+	gotSeq, ok = demuxSeq(te, &rawIcmp{network: networkIPv4}, wantID, false)
+	if !ok || gotSeq != wantSeq {
+		t.Fatalf("demuxSeq(TimeExceeded): got (%d, %v), want (%d, true)", gotSeq, ok, wantSeq)
+	}
+}
+
+//TestFragNeededMTU exercises fragNeededMTU against a synthetic code 4
+//Destination Unreachable datagram, and confirms a different code (one
+//without a next-hop MTU field) reports 0 rather than misreading bytes 6:8.
+func TestFragNeededMTU(t *testing.T) {
+	const wantMTU = 1400
+	raw := make([]byte, 8)
+	binary.BigEndian.PutUint16(raw[6:8], wantMTU)
+
+	rm := &icmp.Message{Type: ipv4.ICMPTypeDestinationUnreachable, Code: icmpv4FragNeededCode}
+	if got := fragNeededMTU(rm, raw); got != wantMTU {
+		t.Fatalf("fragNeededMTU = %d, want %d", got, wantMTU)
+	}
+
+	rm.Code = 1 //host/network unreachable: no MTU carried
+	if got := fragNeededMTU(rm, raw); got != 0 {
+		t.Fatalf("fragNeededMTU for code 1 = %d, want 0", got)
+	}
+}
+
+//TestSetDontFragmentOnRealSocket is a regression test for the bug
+//netListenPacketer's raw-socket fix addressed: setDontFragment needs a
+//syscall.Conn, which icmp.ListenPacket's *icmp.PacketConn never exposes
+//for "ip4:icmp"/"ip6:ipv6-icmp". It's skipped where CAP_NET_RAW, or the
+//IP_MTU_DISCOVER sockopt itself, isn't available (e.g. some sandboxes).
+func TestSetDontFragmentOnRealSocket(t *testing.T) {
+	c, err := (netListenPacketer{}).ListenPacket(networkIPv4, "0.0.0.0")
+	if err != nil {
+		t.Skipf("could not open a raw socket (need CAP_NET_RAW?): %v", err)
+	}
+	defer c.Close()
+
+	if _, ok := c.(syscall.Conn); !ok {
+		t.Fatalf("netListenPacketer's connection does not implement syscall.Conn")
+	}
+	if err := setDontFragment(c, true); err != nil {
+		if errors.Is(err, syscall.EOPNOTSUPP) || errors.Is(err, syscall.ENOPROTOOPT) {
+			t.Skipf("IP_MTU_DISCOVER not supported in this environment: %v", err)
+		}
+		t.Fatalf("setDontFragment(true): %v", err)
+	}
+	if err := setDontFragment(c, false); err != nil {
+		t.Fatalf("setDontFragment(false): %v", err)
+	}
+}
+
+//TestCoordinatorDontFragmentRealSocket drives a Coordinator through its
+//default, unmocked ListenPacketer and pings localhost with DontFragment
+//set, proving sendMessage4's setDontFragment call doesn't error out on the
+//connection type the Coordinator actually uses in production. It's skipped
+//where CAP_NET_RAW, or the IP_MTU_DISCOVER sockopt itself, isn't available.
+func TestCoordinatorDontFragmentRealSocket(t *testing.T) {
+	co, err := NewCoordinator(netListenPacketer{}, false, testLogger{}, 1)
+	if err != nil {
+		t.Skipf("could not open a raw socket (need CAP_NET_RAW?): %v", err)
+	}
+	defer co.Close()
+
+	echo := make(chan *Ping, 1)
+	co.Ping() <- Ping{To: "127.0.0.1", DontFragment: true, EchoChannel: echo}
+
+	select {
+	case pi := <-echo:
+		if pi.Pong.Err != nil {
+			if strings.Contains(pi.Pong.Err.Error(), syscall.EOPNOTSUPP.Error()) {
+				t.Skipf("IP_MTU_DISCOVER not supported in this environment: %v", pi.Pong.Err)
+			}
+			t.Fatalf("Pong.Err = %v, want nil", pi.Pong.Err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for the echo reply")
+	}
+}
@@ -0,0 +1,102 @@
+package ggping
+
+import (
+	"context"
+	"sync/atomic"
+
+	"golang.org/x/net/icmp"
+
+	"github.com/gracig/goping"
+)
+
+//Pinger adapts a Coordinator to the goping.Pinger interface: it translates
+//each goping.Request's Config (Unprivileged, TTL, TOS, PacketSize,
+//DontFragment, Traceroute/MaxHops/Probes) into a Ping submitted to the
+//Coordinator, and the matching Pong back into a goping.RawResponse.
+type Pinger struct {
+	co  *Coordinator
+	seq uint32 //assigns the Response.Seq goping.Start() reports; independent of the Coordinator's own (id, seq) demux bookkeeping
+}
+
+//NewPinger returns a goping.Pinger backed by co.
+func NewPinger(co *Coordinator) *Pinger {
+	return &Pinger{co: co}
+}
+
+//Ping submits r to the Coordinator and returns a channel that receives the
+//matching RawResponse once the reply (or a resolve/send failure) arrives.
+func (gp *Pinger) Ping(ctx context.Context, r goping.Request) (<-chan goping.RawResponse, int, error) {
+	seq := int(atomic.AddUint32(&gp.seq, 1))
+
+	pi := Ping{
+		To:           r.Host,
+		Unprivileged: r.Config.Unprivileged,
+		TTL:          ttlFor(r),
+		TOS:          r.Config.TOS,
+		PacketSize:   r.Config.PacketSize,
+		DontFragment: r.Config.DontFragment,
+		EchoChannel:  make(chan *Ping, 1),
+	}
+
+	select {
+	case gp.co.Ping() <- pi:
+	case <-ctx.Done():
+		return nil, seq, ctx.Err()
+	}
+
+	future := make(chan goping.RawResponse, 1)
+	go func() {
+		select {
+		case reply := <-pi.EchoChannel:
+			future <- rawResponseFrom(reply.Pong)
+		case <-ctx.Done():
+		}
+	}()
+
+	return future, seq, nil
+}
+
+//Close releases the underlying Coordinator's sockets.
+func (gp *Pinger) Close() error {
+	return gp.co.Close()
+}
+
+//ttlFor picks the TTL to stamp on this iteration's probe: a fixed
+//Config.TTL normally, or, in traceroute mode, one that climbs by one hop
+//every Config.Probes iterations (1, 1, ..., 2, 2, ..., up to MaxHops),
+//driven by r.Sent, which Start() has already incremented for this
+//iteration before calling Ping.
+func ttlFor(r goping.Request) int {
+	if !r.Config.Traceroute {
+		return r.Config.TTL
+	}
+	probes := r.Config.Probes
+	if probes < 1 {
+		probes = 1
+	}
+	hop := 1 + (int(r.Sent)-1)/probes
+	if r.Config.MaxHops > 0 && hop > r.Config.MaxHops {
+		hop = r.Config.MaxHops
+	}
+	return hop
+}
+
+//rawResponseFrom turns a Pong into the goping.RawResponse Start()
+//classifies via its ICMPMessage.Type/Code switch. A Pong.Err (a resolve,
+//send, or coordinator-shutdown failure) surfaces through RawResponse.Err
+//instead, since those probes never got far enough to have an ICMP reply.
+func rawResponseFrom(pg Pong) goping.RawResponse {
+	if pg.Err != nil {
+		return goping.RawResponse{Err: pg.Err}
+	}
+	return goping.RawResponse{
+		RTT:        pg.Rtt,
+		From:       pg.From,
+		TTL:        pg.TTL,
+		NextHopMTU: pg.NextHopMTU,
+		ICMPMessage: icmp.Message{
+			Type: pg.ICMPType,
+			Code: pg.ICMPCode,
+		},
+	}
+}